@@ -0,0 +1,151 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/xenolf/lego/certificate"
+	"github.com/xenolf/lego/lego"
+)
+
+// acmeHTTPTimeout bounds every HTTP exchange an ACME client makes
+// with the CA. lego gives us no way to cancel a specific in-flight
+// request, so this is what keeps a canceled Issue or Revoke call
+// from leaving its background goroutine to run indefinitely; it
+// caps it at a generous but finite duration instead.
+const acmeHTTPTimeout = 2 * time.Minute
+
+// acmeCertMetadata is what ACMEIssuer.Issue stores in
+// IssuedCertificate.Metadata: the ACME order URLs for the
+// certificate, so a later RevokeCertContext or renewal has them
+// without needing to replay the order against the CA.
+type acmeCertMetadata struct {
+	CertURL       string `json:"certUrl,omitempty"`
+	CertStableURL string `json:"certStableUrl,omitempty"`
+}
+
+// ACMEIssuer is the default Issuer: it obtains and revokes
+// certificates from an ACME CA using the lego client. When no
+// Issuers are configured, Config uses a single ACMEIssuer built
+// from the package-level CA and the Config's Email and Agreed.
+type ACMEIssuer struct {
+	// The endpoint of the directory for the ACME CA to use
+	CA string
+
+	// The email address to use when creating or selecting an
+	// existing ACME server account
+	Email string
+
+	// Set to true if agreed to the CA's subscriber agreement
+	Agreed bool
+
+	// cfg is set by Config when this issuer is attached to it,
+	// so that newACMEClient can reuse cfg's challenge settings,
+	// client cache, and interactive-prompt behavior.
+	cfg *Config
+}
+
+// IssuerKey returns the ACME CA directory endpoint, which is
+// used to namespace this issuer's certificates in storage so
+// that certs from different CAs can coexist.
+func (iss *ACMEIssuer) IssuerKey() string {
+	return iss.CA
+}
+
+// Issue obtains a certificate for the name(s) on csr from the
+// ACME CA at iss.CA, honoring ctx for cancellation.
+//
+// lego's client has no cancellation hook for an order already in
+// flight, so canceling ctx unblocks the caller immediately but
+// leaves the underlying HTTP exchange with the CA to finish in the
+// background; its result is simply discarded. That background
+// exchange is not unbounded, though: the client's HTTPClient.Timeout
+// (see newACMEClientForIssuer) caps it at acmeHTTPTimeout, so the
+// goroutine is guaranteed to exit within that bound even though ctx
+// can't abort it any sooner.
+func (iss *ACMEIssuer) Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error) {
+	client, err := iss.newACMEClient(ctx, false)
+	if err != nil {
+		return nil, err
+	}
+
+	type result struct {
+		resource certificate.Resource
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		resource, err := client.Certificate.ObtainForCSR(*csr, true)
+		done <- result{resource, err}
+	}()
+
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-done:
+		if r.err != nil {
+			return nil, fmt.Errorf("%s: %v", iss.CA, r.err)
+		}
+		metadata, err := json.Marshal(acmeCertMetadata{
+			CertURL:       r.resource.CertURL,
+			CertStableURL: r.resource.CertStableURL,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: encoding certificate metadata: %v", iss.CA, err)
+		}
+		return &IssuedCertificate{
+			Certificate: r.resource.Certificate,
+			PrivateKey:  r.resource.PrivateKey,
+			Metadata:    metadata,
+		}, nil
+	}
+}
+
+// Revoke revokes cert via the ACME CA at iss.CA, honoring ctx for
+// cancellation. As with Issue, an in-flight revocation request is
+// not actually aborted when ctx is canceled -- the caller is just
+// unblocked while it finishes in the background, bounded by the
+// same acmeHTTPTimeout.
+func (iss *ACMEIssuer) Revoke(ctx context.Context, cert CertificateResource, reason int) error {
+	client, err := iss.newACMEClient(ctx, false)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Certificate.RevokeWithReason(cert.Certificate, &reason)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-done:
+		return err
+	}
+}
+
+// newACMEClient sets up a lego client configured to use iss's
+// ACME CA and account, reusing a cached one from iss.cfg if
+// available. If interactive is true, the user may be shown a
+// prompt (e.g. to accept the subscriber agreement).
+func (iss *ACMEIssuer) newACMEClient(ctx context.Context, interactive bool) (*lego.Client, error) {
+	return iss.cfg.newACMEClientForIssuer(ctx, iss, interactive)
+}
@@ -15,7 +15,9 @@
 package certmagic
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"sync"
 	"time"
@@ -27,13 +29,29 @@ import (
 	"github.com/xenolf/lego/lego"
 )
 
+// issuerKeyOf returns the storage key component used to namespace
+// certificates obtained from iss, so that certificates from different
+// CAs can coexist in the same storage without colliding.
+func issuerKeyOf(iss Issuer) string {
+	if iss == nil {
+		return CA
+	}
+	return iss.IssuerKey()
+}
+
 // Config configures a certificate manager instance.
 // An empty Config is not valid: use New() to obtain
 // a valid Config.
 type Config struct {
-	// The endpoint of the directory for the ACME
-	// CA we are to use
-	CA string
+	// The ordered list of issuers to obtain and renew
+	// certificates from. They are tried in order, and
+	// the next one is tried if one fails, so that, for
+	// example, a primary CA experiencing an outage or
+	// rate-limiting a name does not stop certificates
+	// from being issued. The issuer that successfully
+	// produced a certificate is recorded and used again
+	// on renewal.
+	Issuers []Issuer
 
 	// The email address to use when creating or
 	// selecting an existing ACME server account
@@ -62,6 +80,10 @@ type Config struct {
 	// relieved.
 	RenewDurationBeforeAtStartup time.Duration
 
+	// How often the maintenance routine (see RunMaintenance) wakes
+	// up to check managed certificates for renewal
+	RenewCheckInterval time.Duration
+
 	// An optional event callback clients can set
 	// to subscribe to certain things happening
 	// internally by this config; invocations are
@@ -104,6 +126,20 @@ type Config struct {
 	// The state needed to operate on-demand TLS
 	OnDemand *OnDemandConfig
 
+	// The sliding-window limits on how many certificates may be
+	// obtained or renewed, per issuer/account/domain-scope, to
+	// avoid tripping CA rate limits. If empty, DefaultRateLimits
+	// is used.
+	RateLimits []RateLimit
+
+	// An optional callback to verify that a name's DNS records
+	// point at this instance before an ACME order is attempted
+	// for it. If nil, a default check is used: it requires an
+	// A/AAAA record matching ListenHost when ListenHost is a
+	// specific public address, and otherwise only that the name
+	// resolves. See PreCheckDNS.
+	DNSPreCheck func(ctx context.Context, name string) error
+
 	// Add the must staple TLS extension to the
 	// CSR generated by lego/acme
 	MustStaple bool
@@ -111,7 +147,8 @@ type Config struct {
 	// Map of hostname to certificate hash; used
 	// to complete handshakes and serve the right
 	// certificate given SNI
-	certificates map[string]string
+	certificates   map[string]string
+	certificatesMu *sync.Mutex
 
 	// Pointer to the certificate store to use
 	certCache *Cache
@@ -120,6 +157,19 @@ type Config struct {
 	// so they can be reused
 	acmeClients   map[string]*lego.Client
 	acmeClientsMu *sync.Mutex
+
+	// Tracks which cached certificates were loaded via the
+	// on-demand path, so the maintenance routine can tell
+	// them apart from proactively managed certificates when
+	// deciding how to react to a revoked certificate
+	onDemandCerts *onDemandTracker
+
+	// Tracks recent successful issuances so RateLimits can be
+	// enforced
+	rateLimiter *rateLimiter
+
+	// Caches recent DNSPreCheck outcomes, see PreCheckDNS
+	dnsPreChecks *dnsPreCheckCache
 }
 
 // NewDefault returns a new, valid, default config.
@@ -162,9 +212,6 @@ func NewWithCache(certCache *Cache, cfg Config) *Config {
 	}
 
 	// fill in default values
-	if cfg.CA == "" {
-		cfg.CA = CA
-	}
 	if cfg.Email == "" {
 		cfg.Email = Email
 	}
@@ -174,6 +221,12 @@ func NewWithCache(certCache *Cache, cfg Config) *Config {
 	if !cfg.Agreed {
 		cfg.Agreed = Agreed
 	}
+	// the default issuer is plain ACME, using the package-level
+	// CA and the settings above; do this after Email/Agreed are filled in so the
+	// default issuer inherits them
+	if len(cfg.Issuers) == 0 {
+		cfg.Issuers = []Issuer{&ACMEIssuer{CA: CA, Email: cfg.Email, Agreed: cfg.Agreed}}
+	}
 	if !cfg.DisableHTTPChallenge {
 		cfg.DisableHTTPChallenge = DisableHTTPChallenge
 	}
@@ -186,6 +239,9 @@ func NewWithCache(certCache *Cache, cfg Config) *Config {
 	if cfg.RenewDurationBeforeAtStartup == 0 {
 		cfg.RenewDurationBeforeAtStartup = RenewDurationBeforeAtStartup
 	}
+	if cfg.RenewCheckInterval == 0 {
+		cfg.RenewCheckInterval = RenewCheckInterval
+	}
 	if cfg.OnEvent == nil {
 		cfg.OnEvent = OnEvent
 	}
@@ -216,22 +272,48 @@ func NewWithCache(certCache *Cache, cfg Config) *Config {
 
 	// ensure the unexported fields are valid
 	cfg.certificates = make(map[string]string)
+	cfg.certificatesMu = new(sync.Mutex)
 	cfg.certCache = certCache
 	cfg.acmeClients = make(map[string]*lego.Client)
 	cfg.acmeClientsMu = new(sync.Mutex)
+	cfg.onDemandCerts = new(onDemandTracker)
+	cfg.rateLimiter = new(rateLimiter)
+	cfg.dnsPreChecks = new(dnsPreCheckCache)
+
+	// give any ACMEIssuer in the list a back-reference to cfg so
+	// it can reach the client cache and challenge settings
+	for _, iss := range cfg.Issuers {
+		if acmeIss, ok := iss.(*ACMEIssuer); ok {
+			acmeIss.cfg = &cfg
+		}
+	}
 
 	return &cfg
 }
 
-// Manage causes the certificates for domainNames to be managed
+// Manage is like ManageSync, but without a context; it passes
+// context.Background() and is kept for backward compatibility.
+func (cfg *Config) Manage(domainNames []string) error {
+	return cfg.ManageSync(context.Background(), domainNames)
+}
+
+// ManageSync causes the certificates for domainNames to be managed
 // according to cfg. If cfg is enabled for OnDemand, then this
 // simply whitelists the domain names. Otherwise, the certificate(s)
 // for each name are loaded from storage or obtained from the CA;
 // and if loaded from storage, renewed if they are expiring or
 // expired. It then caches the certificate in memory and is
 // prepared to serve them up during TLS handshakes.
-func (cfg *Config) Manage(domainNames []string) error {
+//
+// It blocks until all of domainNames have been managed or ctx is
+// done, whichever comes first; if ctx is canceled partway through,
+// the remaining names are left unmanaged and ctx.Err() is returned.
+func (cfg *Config) ManageSync(ctx context.Context, domainNames []string) error {
 	for _, domainName := range domainNames {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
 		// if on-demand is configured, simply whitelist this name
 		if cfg.OnDemand != nil {
 			if !cfg.OnDemand.whitelistContains(domainName) {
@@ -246,8 +328,16 @@ func (cfg *Config) Manage(domainNames []string) error {
 		if err != nil {
 			if _, ok := err.(ErrNotExist); ok {
 				// if it doesn't exist, get it, then try loading it again
-				err := cfg.ObtainCert(domainName, false)
+				err := cfg.ObtainCertContext(ctx, domainName, false)
 				if err != nil {
+					if ctxErr := ctx.Err(); ctxErr != nil {
+						return ctxErr
+					}
+					var rl ErrRateLimited
+					if errors.As(err, &rl) {
+						cfg.backOffRateLimited(domainName, rl)
+						continue
+					}
 					return fmt.Errorf("%s: obtaining certificate: %v", domainName, err)
 				}
 				cert, err = cfg.CacheManagedCertificate(domainName)
@@ -261,8 +351,16 @@ func (cfg *Config) Manage(domainNames []string) error {
 
 		// for existing certificates, make sure it is renewed
 		if cert.NeedsRenewal() {
-			err := cfg.RenewCert(domainName, false)
+			err := cfg.RenewCertContext(ctx, domainName, false)
 			if err != nil {
+				if ctxErr := ctx.Err(); ctxErr != nil {
+					return ctxErr
+				}
+				var rl ErrRateLimited
+				if errors.As(err, &rl) {
+					cfg.backOffRateLimited(domainName, rl)
+					continue
+				}
 				return fmt.Errorf("%s: renewing certificate: %v", domainName, err)
 			}
 		}
@@ -271,16 +369,66 @@ func (cfg *Config) Manage(domainNames []string) error {
 	return nil
 }
 
-// ObtainCert obtains a certificate for name using cfg, as long
-// as a certificate does not already exist in storage for that
-// name. The name must qualify and cfg must be flagged as Managed.
+// backOffRateLimited reports, via cfg.OnEvent (event
+// "manage_rate_limited"), that domainName could not be obtained or
+// renewed right now because it is rate limited, and by how long the
+// caller should expect to wait before it's likely to succeed. The
+// caller (ManageSync) skips this name and continues with the rest
+// of the batch, rather than hammering the CA with an order that is
+// certain to be rejected or aborting every other domain over it.
+func (cfg *Config) backOffRateLimited(domainName string, rl ErrRateLimited) {
+	if cfg.OnEvent != nil {
+		cfg.OnEvent("manage_rate_limited", map[string]interface{}{
+			"domain":      domainName,
+			"key":         rl.Key,
+			"retry_after": rl.RetryAfter,
+		})
+	}
+}
+
+// ManageAsync is like ManageSync, except that it returns
+// immediately and performs the management of domainNames in a
+// new goroutine. Any error is reported through cfg.OnEvent
+// (event "manage_async_error") instead of being returned, since
+// there is no synchronous caller to return it to. Canceling ctx
+// stops the goroutine at its next opportunity, abandoning any
+// names not yet managed.
+func (cfg *Config) ManageAsync(ctx context.Context, domainNames []string) {
+	go func() {
+		if err := cfg.ManageSync(ctx, domainNames); err != nil {
+			if cfg.OnEvent != nil {
+				cfg.OnEvent("manage_async_error", err)
+			}
+		}
+	}()
+}
+
+// ObtainCert is like ObtainCertContext, but without a context;
+// it passes context.Background() and is kept for backward
+// compatibility.
+func (cfg *Config) ObtainCert(name string, interactive bool) error {
+	return cfg.ObtainCertContext(context.Background(), name, interactive)
+}
+
+// ObtainCertContext obtains a certificate for name using cfg, as
+// long as a certificate does not already exist in storage for
+// that name from any of cfg.Issuers. The name must qualify.
 // This function is a no-op if storage already has a certificate
 // for name.
 //
+// It tries cfg.Issuers in order, moving on to the next one if
+// an issuer fails, and returns a report of all the failures
+// only once every issuer has been exhausted. The issuer that
+// succeeds is recorded as part of the certificate's storage
+// key, so that certificates from different CAs can coexist.
+//
 // It only obtains and stores certificates (and their keys),
 // it does not load them into memory. If interactive is true,
-// the user may be shown a prompt.
-func (cfg *Config) ObtainCert(name string, interactive bool) error {
+// the user may be shown a prompt. Canceling ctx unblocks the
+// caller as soon as whichever issuer is currently being tried
+// notices (see ACMEIssuer.Issue for the caveat on in-flight
+// requests).
+func (cfg *Config) ObtainCertContext(ctx context.Context, name string, interactive bool) error {
 	skip, err := cfg.preObtainOrRenewChecks(name, interactive)
 	if err != nil {
 		return err
@@ -289,21 +437,33 @@ func (cfg *Config) ObtainCert(name string, interactive bool) error {
 		return nil
 	}
 
-	if cfg.storageHasCertResources(name) {
+	if cfg.storageHasCertResourcesFromAnyIssuer(name) {
 		return nil
 	}
 
-	client, err := cfg.newACMEClient(interactive)
-	if err != nil {
+	if err := cfg.PreCheckDNS(ctx, name); err != nil {
 		return err
 	}
 
-	return client.Obtain(name)
+	return cfg.obtainWithIssuers(ctx, cfg.Issuers, name)
 }
 
-// RenewCert renews the certificate for name using cfg. It stows the
-// renewed certificate and its assets in storage if successful.
+// RenewCert is like RenewCertContext, but without a context; it
+// passes context.Background() and is kept for backward
+// compatibility.
 func (cfg *Config) RenewCert(name string, interactive bool) error {
+	return cfg.RenewCertContext(context.Background(), name, interactive)
+}
+
+// RenewCertContext renews the certificate for name using cfg. It
+// stows the renewed certificate and its assets in storage if
+// successful. The issuer that produced the certificate currently
+// in storage is tried first, and the rest of cfg.Issuers are
+// tried in order if that issuer is unavailable. Canceling ctx
+// unblocks the caller as soon as whichever issuer is currently
+// being tried notices (see ACMEIssuer.Issue for the caveat on
+// in-flight requests).
+func (cfg *Config) RenewCertContext(ctx context.Context, name string, interactive bool) error {
 	skip, err := cfg.preObtainOrRenewChecks(name, interactive)
 	if err != nil {
 		return err
@@ -311,20 +471,100 @@ func (cfg *Config) RenewCert(name string, interactive bool) error {
 	if skip {
 		return nil
 	}
-	client, err := cfg.newACMEClient(interactive)
+
+	return cfg.obtainWithIssuers(ctx, cfg.issuersPreferring(name), name)
+}
+
+// obtainWithIssuers tries each issuer in order until one succeeds,
+// then saves the resulting certificate under that issuer's key.
+// If all issuers fail, a single error reporting every failure is
+// returned -- unless every failure was a rate limit rejection, in
+// which case a single ErrRateLimited (the soonest to clear) is
+// returned instead, so callers like ManageSync can back off on this
+// name rather than treating it as a hard failure.
+func (cfg *Config) obtainWithIssuers(ctx context.Context, issuers []Issuer, name string) error {
+	csr, err := cfg.generateCSR(name)
 	if err != nil {
-		return err
+		return fmt.Errorf("%s: generating CSR: %v", name, err)
 	}
-	return client.Renew(name)
+
+	var errs []error
+	var rateLimited []ErrRateLimited
+	for _, iss := range issuers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := cfg.checkRateLimit(iss, name); err != nil {
+			var rl ErrRateLimited
+			if errors.As(err, &rl) {
+				rateLimited = append(rateLimited, rl)
+			}
+			errs = append(errs, fmt.Errorf("%s: %v", issuerKeyOf(iss), err))
+			continue
+		}
+		issued, err := iss.Issue(ctx, csr)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", issuerKeyOf(iss), err))
+			continue
+		}
+		cfg.recordIssuance(iss, name)
+		if err := cfg.saveCertResource(iss, name, issued); err != nil {
+			return fmt.Errorf("%s: saving certificate: %v", name, err)
+		}
+		if err := cfg.deleteCertResourcesFromOtherIssuers(iss, name); err != nil {
+			return fmt.Errorf("%s: deleting superseded certificate: %v", name, err)
+		}
+		return nil
+	}
+
+	if len(rateLimited) > 0 && len(rateLimited) == len(issuers) {
+		soonest := rateLimited[0]
+		for _, rl := range rateLimited[1:] {
+			if rl.RetryAfter < soonest.RetryAfter {
+				soonest = rl
+			}
+		}
+		return soonest
+	}
+
+	return fmt.Errorf("%s: all issuers failed: %v", name, errs)
 }
 
-// RevokeCert revokes the certificate for domain via ACME protocol.
-func (cfg *Config) RevokeCert(domain string, interactive bool) error {
-	client, err := cfg.newACMEClient(interactive)
+// RevokeCert is like RevokeCertContext, but without a context; it
+// passes context.Background() and is kept for backward
+// compatibility.
+func (cfg *Config) RevokeCert(domain string, reason int, interactive bool) error {
+	return cfg.RevokeCertContext(context.Background(), domain, reason, interactive)
+}
+
+// RevokeCertContext revokes the certificate for domain, with the
+// given reason code, via whichever issuer in cfg.Issuers produced
+// it (as recorded alongside the certificate in storage).
+func (cfg *Config) RevokeCertContext(ctx context.Context, domain string, reason int, interactive bool) error {
+	iss, cert, err := cfg.issuerAndCertFor(domain)
 	if err != nil {
 		return err
 	}
-	return client.Revoke(domain)
+	return iss.Revoke(ctx, cert, reason)
+}
+
+// issuersPreferring returns cfg.Issuers with the issuer that
+// produced name's certificate currently in storage (if any)
+// moved to the front, so renewal prefers the CA the cert
+// already came from before falling back to the others.
+func (cfg *Config) issuersPreferring(name string) []Issuer {
+	iss, _, err := cfg.issuerAndCertFor(name)
+	if err != nil || iss == nil {
+		return cfg.Issuers
+	}
+	ordered := make([]Issuer, 0, len(cfg.Issuers))
+	ordered = append(ordered, iss)
+	for _, other := range cfg.Issuers {
+		if issuerKeyOf(other) != issuerKeyOf(iss) {
+			ordered = append(ordered, other)
+		}
+	}
+	return ordered
 }
 
 // TLSConfig is an opinionated method that returns a
@@ -379,17 +619,108 @@ func (cfg *Config) preObtainOrRenewChecks(name string, allowPrompts bool) (bool,
 
 // storageHasCertResources returns true if the storage
 // associated with cfg's certificate cache has all the
-// resources related to the certificate for domain: the
-// certificate, the private key, and the metadata.
-func (cfg *Config) storageHasCertResources(domain string) bool {
-	certKey := StorageKeys.SiteCert(cfg.CA, domain)
-	keyKey := StorageKeys.SitePrivateKey(cfg.CA, domain)
-	metaKey := StorageKeys.SiteMeta(cfg.CA, domain)
+// resources related to the certificate for domain issued
+// by issuerKey: the certificate, the private key, and
+// the metadata.
+func (cfg *Config) storageHasCertResources(issuerKey, domain string) bool {
+	certKey := StorageKeys.SiteCert(issuerKey, domain)
+	keyKey := StorageKeys.SitePrivateKey(issuerKey, domain)
+	metaKey := StorageKeys.SiteMeta(issuerKey, domain)
 	return cfg.certCache.storage.Exists(certKey) &&
 		cfg.certCache.storage.Exists(keyKey) &&
 		cfg.certCache.storage.Exists(metaKey)
 }
 
+// storageHasCertResourcesFromAnyIssuer returns true if storage
+// already has a complete certificate for domain from any of
+// cfg.Issuers.
+func (cfg *Config) storageHasCertResourcesFromAnyIssuer(domain string) bool {
+	for _, iss := range cfg.Issuers {
+		if cfg.storageHasCertResources(issuerKeyOf(iss), domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// issuerAndCertFor looks through cfg.Issuers, in order, for the
+// one that has a certificate for domain in storage, and loads
+// that certificate's resource alongside it. It is used to find
+// which issuer produced an existing certificate, e.g. for
+// renewal or revocation.
+func (cfg *Config) issuerAndCertFor(domain string) (Issuer, CertificateResource, error) {
+	for _, iss := range cfg.Issuers {
+		issuerKey := issuerKeyOf(iss)
+		if !cfg.storageHasCertResources(issuerKey, domain) {
+			continue
+		}
+		cert, err := cfg.loadCertResource(issuerKey, domain)
+		if err != nil {
+			return nil, CertificateResource{}, fmt.Errorf("%s: loading certificate resource: %v", domain, err)
+		}
+		return iss, cert, nil
+	}
+	return nil, CertificateResource{}, ErrNotExist(fmt.Errorf("%s: no certificate in storage from any issuer", domain))
+}
+
+// deleteCertResourcesFromOtherIssuers deletes any complete
+// certificate resource set for name left behind by an issuer other
+// than iss. It's called after a fallback issuer produces a
+// replacement certificate, so the superseded one can't outrank the
+// fresh certificate the next time issuerAndCertFor picks the first
+// issuer in cfg.Issuers order with a complete resource set on disk --
+// which would otherwise leave RenewCertContext preferring a stale
+// issuer, and RevokeCertContext and the revocation check in
+// maintain_revocation.go operating on the wrong certificate.
+func (cfg *Config) deleteCertResourcesFromOtherIssuers(iss Issuer, name string) error {
+	issuerKey := issuerKeyOf(iss)
+	for _, other := range cfg.Issuers {
+		otherKey := issuerKeyOf(other)
+		if otherKey == issuerKey || !cfg.storageHasCertResources(otherKey, name) {
+			continue
+		}
+		if err := cfg.deleteCertResources(otherKey, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newACMEClientForIssuer sets up a lego client for iss, reusing
+// one already cached in cfg.acmeClients under iss's key if one
+// was built before (lego clients are expensive to construct since
+// they fetch the CA's directory and, the first time, register an
+// account). If interactive is true, the user may be shown a
+// prompt, e.g. to accept the CA's subscriber agreement.
+func (cfg *Config) newACMEClientForIssuer(ctx context.Context, iss *ACMEIssuer, interactive bool) (*lego.Client, error) {
+	cfg.acmeClientsMu.Lock()
+	defer cfg.acmeClientsMu.Unlock()
+
+	cacheKey := iss.CA + iss.Email
+	if client, ok := cfg.acmeClients[cacheKey]; ok {
+		return client, nil
+	}
+
+	client, err := newACMEClient(ctx, iss.CA, iss.Email, iss.Agreed, cfg, interactive)
+	if err != nil {
+		return nil, err
+	}
+
+	// lego has no per-call cancellation hook for an order already in
+	// flight (see ACMEIssuer.Issue), so a canceled ctx can't abort a
+	// specific HTTP exchange this shared, cached client is in the
+	// middle of. Bounding the client's own HTTP timeout instead caps
+	// how long any such exchange -- and the goroutine waiting on it --
+	// can run for, rather than leaving it to the CA or network to
+	// decide. This is set once here, before the client is cached and
+	// shared, so it's safe to do without synchronizing every Issue
+	// or Revoke call against it.
+	client.HTTPClient.Timeout = acmeHTTPTimeout
+
+	cfg.acmeClients[cacheKey] = client
+	return client, nil
+}
+
 // managedCertNeedsRenewal returns true if certRes is
 // expiring soon or already expired, or if the process
 // of checking the expiration returned an error.
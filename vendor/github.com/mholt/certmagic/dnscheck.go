@@ -0,0 +1,176 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// dnsPreCheckTTL is how long a DNS pre-check result is cached for,
+// to avoid hammering the resolver during a flood of handshakes for
+// the same (often bogus) SNI.
+const dnsPreCheckTTL = 1 * time.Minute
+
+// dnsPreCheckSweepInterval is how often set prunes expired entries
+// out of the cache. Without this, a flood of handshakes for distinct
+// bogus SNIs -- each cached exactly once and never looked up again --
+// would grow the map without bound, turning the defense itself into
+// a memory-exhaustion vector.
+const dnsPreCheckSweepInterval = 1 * time.Minute
+
+// ErrDNSMismatch is returned by (*Config).PreCheckDNS when a name's
+// DNS records don't point at this instance, so an ACME challenge for
+// it is guaranteed to fail.
+type ErrDNSMismatch struct {
+	Name string
+	Err  error
+}
+
+func (e ErrDNSMismatch) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("%s: DNS pre-check failed: %v", e.Name, e.Err)
+	}
+	return fmt.Sprintf("%s: DNS pre-check failed", e.Name)
+}
+
+// dnsPreCheckCache remembers recent DNS pre-check outcomes for a
+// short TTL so repeated lookups of the same name (e.g. from a flood
+// of handshakes) don't all hit the resolver.
+type dnsPreCheckCache struct {
+	mu        sync.Mutex
+	entries   map[string]dnsPreCheckResult
+	lastSweep time.Time
+}
+
+type dnsPreCheckResult struct {
+	ok      bool
+	expires time.Time
+}
+
+func (c *dnsPreCheckCache) get(name string, now time.Time) (ok, found bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	result, exists := c.entries[name]
+	if !exists || now.After(result.expires) {
+		return false, false
+	}
+	return result.ok, true
+}
+
+func (c *dnsPreCheckCache) set(name string, ok bool, now time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]dnsPreCheckResult)
+	}
+	c.entries[name] = dnsPreCheckResult{ok: ok, expires: now.Add(dnsPreCheckTTL)}
+	c.sweep(now)
+}
+
+// sweep removes expired entries from the cache. It is amortized
+// across calls to set (at most once per dnsPreCheckSweepInterval)
+// rather than running on every lookup, so a flood of handshakes
+// can't turn pruning itself into a hot loop.
+func (c *dnsPreCheckCache) sweep(now time.Time) {
+	if now.Sub(c.lastSweep) < dnsPreCheckSweepInterval {
+		return
+	}
+	c.lastSweep = now
+	for name, result := range c.entries {
+		if now.After(result.expires) {
+			delete(c.entries, name)
+		}
+	}
+}
+
+// PreCheckDNS verifies that name is plausibly pointed at this
+// instance before an ACME order is attempted for it, so that a
+// bad SNI (e.g. from a scanner) or a misconfigured domain fails
+// fast instead of waiting for a challenge that is guaranteed to
+// fail -- which also keeps it from burning CA rate-limit quota.
+//
+// If cfg.DNSPreCheck is set, it is used as the check; otherwise,
+// the default check looks up name's A/AAAA records and, if
+// cfg.ListenHost is a specific public-facing address, requires at
+// least one to match it -- otherwise it only requires that name
+// resolves at all. Results are cached for dnsPreCheckTTL to avoid
+// resolver load during handshake floods. External decision
+// functions (e.g. for on-demand TLS) may call this directly to get
+// the same fast-fail behavior.
+func (cfg *Config) PreCheckDNS(ctx context.Context, name string) error {
+	now := time.Now()
+	if ok, found := cfg.dnsPreChecks.get(name, now); found {
+		if ok {
+			return nil
+		}
+		return ErrDNSMismatch{Name: name}
+	}
+
+	check := cfg.DNSPreCheck
+	if check == nil {
+		check = cfg.defaultDNSPreCheck
+	}
+
+	err := check(ctx, name)
+	cfg.dnsPreChecks.set(name, err == nil, now)
+	if err != nil {
+		return ErrDNSMismatch{Name: name, Err: err}
+	}
+	return nil
+}
+
+// defaultDNSPreCheck resolves name's A/AAAA records and requires at
+// least one to match cfg.ListenHost. If cfg.ListenHost is empty, or
+// isn't a specific public-facing address (see listenHostIsPublic),
+// it only requires that name resolves to at least one address.
+func (cfg *Config) defaultDNSPreCheck(ctx context.Context, name string) error {
+	var resolver net.Resolver
+	addrs, err := resolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return fmt.Errorf("looking up %s: %v", name, err)
+	}
+	if len(addrs) == 0 {
+		return fmt.Errorf("no A/AAAA records found for %s", name)
+	}
+	if !listenHostIsPublic(cfg.ListenHost) {
+		return nil
+	}
+	for _, addr := range addrs {
+		if addr.IP.String() == cfg.ListenHost {
+			return nil
+		}
+	}
+	return fmt.Errorf("no A/AAAA record for %s matches listen host %s", name, cfg.ListenHost)
+}
+
+// listenHostIsPublic reports whether host is a specific address
+// worth requiring a domain's DNS records to match, as opposed to
+// empty, a wildcard bind address ("0.0.0.0", "::"), a loopback
+// address, or a private-network address. ListenHost is the bind
+// address for the ACME challenge listener, and is commonly one of
+// those values -- none of which a domain's public A/AAAA record will
+// ever literally equal, even when DNS is configured correctly.
+func listenHostIsPublic(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	return !ip.IsUnspecified() && !ip.IsLoopback() &&
+		!ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast()
+}
@@ -0,0 +1,148 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+)
+
+// Issuer is a type that can issue and revoke certificates. The
+// default Issuer is ACMEIssuer, but any CA that can satisfy this
+// interface may be plugged in, allowing a Config to fall back from
+// one CA to another if the first is unavailable (rate-limited,
+// experiencing an outage, etc).
+type Issuer interface {
+	// IssuerKey returns a string that uniquely identifies this
+	// issuer, such as the CA's directory endpoint. It is used to
+	// namespace certificates in storage so that certificates from
+	// different issuers can coexist.
+	IssuerKey() string
+
+	// Issue obtains a certificate for the name(s) on the CSR.
+	Issue(ctx context.Context, csr *x509.CertificateRequest) (*IssuedCertificate, error)
+
+	// Revoke revokes the given certificate.
+	Revoke(ctx context.Context, cert CertificateResource, reason int) error
+}
+
+// IssuedCertificate represents a certificate that was just
+// issued by an Issuer, ready to be stored.
+type IssuedCertificate struct {
+	// The PEM-encoded certificate chain, leaf first.
+	Certificate []byte
+
+	// The PEM-encoded private key for the certificate.
+	PrivateKey []byte
+
+	// Any issuer-specific metadata worth persisting
+	// alongside the certificate (account info, order
+	// URLs, etc), encoded however the issuer likes.
+	Metadata []byte
+}
+
+// CertificateResource is a certificate and its associated assets
+// as loaded from storage, along with the name it was issued for.
+// It is the input to Issuer.Revoke.
+type CertificateResource struct {
+	SANs        []string
+	Certificate []byte
+	PrivateKey  []byte
+	Metadata    []byte
+}
+
+// generateCSR creates a simple certificate signing request for
+// name, to be handed to an Issuer. It uses cfg.KeyType to choose
+// the key algorithm for the corresponding private key, and adds
+// the TLS Feature (must staple) extension if cfg.MustStaple is set.
+func (cfg *Config) generateCSR(name string) (*x509.CertificateRequest, error) {
+	privateKey, err := generatePrivateKey(cfg.KeyType)
+	if err != nil {
+		return nil, fmt.Errorf("generating private key: %v", err)
+	}
+
+	csrTemplate := &x509.CertificateRequest{
+		Subject:  pkix.Name{CommonName: name},
+		DNSNames: []string{name},
+	}
+	if cfg.MustStaple {
+		// id-pe-tlsfeature, value SEQUENCE { INTEGER 5 } (status_request)
+		csrTemplate.ExtraExtensions = append(csrTemplate.ExtraExtensions, pkix.Extension{
+			Id:    asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 1, 24},
+			Value: []byte{0x30, 0x03, 0x02, 0x01, 0x05},
+		})
+	}
+
+	csrDER, err := x509.CreateCertificateRequest(rand.Reader, csrTemplate, privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("creating CSR: %v", err)
+	}
+
+	csr, err := x509.ParseCertificateRequest(csrDER)
+	if err != nil {
+		return nil, fmt.Errorf("parsing CSR: %v", err)
+	}
+
+	return csr, nil
+}
+
+// saveCertResource saves the certificate resource to storage,
+// namespaced by the issuer that produced it, so that certificates
+// from different issuers do not collide.
+func (cfg *Config) saveCertResource(iss Issuer, name string, issued *IssuedCertificate) error {
+	issuerKey := issuerKeyOf(iss)
+
+	err := cfg.certCache.storage.Store(StorageKeys.SiteCert(issuerKey, name), issued.Certificate)
+	if err != nil {
+		return fmt.Errorf("%s: saving certificate: %v", name, err)
+	}
+	err = cfg.certCache.storage.Store(StorageKeys.SitePrivateKey(issuerKey, name), issued.PrivateKey)
+	if err != nil {
+		return fmt.Errorf("%s: saving private key: %v", name, err)
+	}
+	err = cfg.certCache.storage.Store(StorageKeys.SiteMeta(issuerKey, name), issued.Metadata)
+	if err != nil {
+		return fmt.Errorf("%s: saving metadata: %v", name, err)
+	}
+
+	return nil
+}
+
+// loadCertResource loads the certificate resource for name that
+// was issued by issuerKey out of storage.
+func (cfg *Config) loadCertResource(issuerKey, name string) (CertificateResource, error) {
+	cert, err := cfg.certCache.storage.Load(StorageKeys.SiteCert(issuerKey, name))
+	if err != nil {
+		return CertificateResource{}, err
+	}
+	key, err := cfg.certCache.storage.Load(StorageKeys.SitePrivateKey(issuerKey, name))
+	if err != nil {
+		return CertificateResource{}, err
+	}
+	meta, err := cfg.certCache.storage.Load(StorageKeys.SiteMeta(issuerKey, name))
+	if err != nil {
+		return CertificateResource{}, err
+	}
+	return CertificateResource{
+		SANs:        []string{name},
+		Certificate: cert,
+		PrivateKey:  key,
+		Metadata:    meta,
+	}, nil
+}
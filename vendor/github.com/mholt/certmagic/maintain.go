@@ -0,0 +1,117 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"time"
+)
+
+// RunMaintenance periodically checks cfg's managed certificates for
+// revocation and renewal until ctx is done, then returns ctx.Err().
+// It wakes up every cfg.RenewCheckInterval.
+//
+// Callers that need to stop the renewal ticker deterministically,
+// e.g. during a graceful shutdown, should run RunMaintenance in its
+// own goroutine and cancel ctx rather than abandoning that goroutine.
+func (cfg *Config) RunMaintenance(ctx context.Context) error {
+	ticker := time.NewTicker(cfg.RenewCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+			cfg.renewManagedCertificates(ctx)
+		}
+	}
+}
+
+// renewManagedCertificates checks the OCSP status of, and renews
+// if necessary, every cached certificate. A failure for one name is
+// reported via cfg.OnEvent rather than aborting the rest of the
+// sweep, and ctx is checked between names so the sweep can be
+// interrupted just like RunMaintenance itself.
+func (cfg *Config) renewManagedCertificates(ctx context.Context) {
+	for _, name := range cfg.managedNames() {
+		if err := ctx.Err(); err != nil {
+			return
+		}
+
+		cfg.checkRevocation(ctx, name)
+
+		cert, err := cfg.CacheManagedCertificate(name)
+		if err != nil || !cert.NeedsRenewal() {
+			continue
+		}
+
+		if err := cfg.RenewCertContext(ctx, name, false); err != nil {
+			if cfg.OnEvent != nil {
+				cfg.OnEvent("renew_error", map[string]interface{}{
+					"domain": name,
+					"error":  err,
+				})
+			}
+		}
+	}
+}
+
+// checkRevocation fetches a fresh OCSP staple for name's current
+// certificate and hands it, along with the certificate's cache hash
+// (the same Certificate.Hash MarkOnDemandCert and NeedsReissue key
+// off of), to CheckOCSPAndReplaceIfRevoked, so a revoked certificate
+// -- managed or on-demand -- is replaced (or, for an on-demand
+// certificate, flagged for reissue) instead of continuing to be
+// served until it expires. OCSP is best-effort here: a responder
+// hiccup or a name with no cached or complete chain is skipped
+// rather than failing the sweep.
+func (cfg *Config) checkRevocation(ctx context.Context, name string) {
+	managed, err := cfg.CacheManagedCertificate(name)
+	if err != nil {
+		return
+	}
+	if len(managed.Certificate.Certificate) < 2 {
+		return
+	}
+	leafDER := managed.Certificate.Certificate[0]
+	issuerDER := managed.Certificate.Certificate[1]
+
+	ocspResp, err := fetchOCSPStaple(ctx, leafDER, issuerDER)
+	if err != nil {
+		return
+	}
+
+	if err := cfg.CheckOCSPAndReplaceIfRevoked(ctx, managed.Hash, []string{name}, ocspResp); err != nil {
+		if cfg.OnEvent != nil {
+			cfg.OnEvent("revocation_check_error", map[string]interface{}{
+				"domain": name,
+				"error":  err,
+			})
+		}
+	}
+}
+
+// managedNames returns the domain names currently in cfg's
+// in-memory certificate cache.
+func (cfg *Config) managedNames() []string {
+	cfg.certificatesMu.Lock()
+	defer cfg.certificatesMu.Unlock()
+	names := make([]string, 0, len(cfg.certificates))
+	for name := range cfg.certificates {
+		names = append(names, name)
+	}
+	return names
+}
@@ -0,0 +1,209 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// onDemandTracker records which cached certificates were loaded via
+// the on-demand path, as opposed to being proactively managed, and
+// which of those have since been revoked and are pending reissue.
+// The maintenance routine consults it when a certificate turns out
+// to be revoked: an on-demand certificate is only flagged for
+// reissue, not reissued right away, so the on-demand decision
+// function still gets a say at the next handshake instead of being
+// bypassed.
+type onDemandTracker struct {
+	mu             sync.Mutex
+	set            map[string]bool
+	pendingReissue map[string]bool
+}
+
+// mark records that certHash was loaded via the on-demand path.
+func (t *onDemandTracker) mark(certHash string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.set == nil {
+		t.set = make(map[string]bool)
+	}
+	t.set[certHash] = true
+}
+
+// unmark forgets that certHash was loaded via the on-demand path,
+// e.g. once it has been replaced with a freshly (non-on-demand)
+// obtained certificate.
+func (t *onDemandTracker) unmark(certHash string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.set, certHash)
+	delete(t.pendingReissue, certHash)
+}
+
+// isOnDemand reports whether certHash was loaded via the on-demand
+// path.
+func (t *onDemandTracker) isOnDemand(certHash string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.set[certHash]
+}
+
+// markPendingReissue flags certHash as revoked and awaiting reissue
+// the next time it's requested on demand.
+func (t *onDemandTracker) markPendingReissue(certHash string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.pendingReissue == nil {
+		t.pendingReissue = make(map[string]bool)
+	}
+	t.pendingReissue[certHash] = true
+}
+
+// isPendingReissue reports whether certHash was revoked and is
+// awaiting reissue.
+func (t *onDemandTracker) isPendingReissue(certHash string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pendingReissue[certHash]
+}
+
+// MarkOnDemandCert records that the certificate identified by
+// certHash was loaded into the cache via the on-demand path. The
+// on-demand handshake code path should call this right after
+// caching a certificate it obtained on demand.
+func (cfg *Config) MarkOnDemandCert(certHash string) {
+	cfg.onDemandCerts.mark(certHash)
+}
+
+// NeedsReissue reports whether the on-demand certificate identified
+// by certHash was revoked and is pending reissue. The on-demand
+// handshake path should consult this before serving a cached
+// certificate, and reissue rather than serve it if true.
+func (cfg *Config) NeedsReissue(certHash string) bool {
+	return cfg.onDemandCerts.isPendingReissue(certHash)
+}
+
+// CheckOCSPAndReplaceIfRevoked should be called by the maintenance
+// routine immediately after it fetches a fresh OCSP response for a
+// managed certificate. If the OCSP responder reports the certificate
+// as revoked, the certificate is deleted from storage and re-obtained,
+// then swapped into the in-memory cache -- unless it was loaded via
+// the on-demand path, in which case its storage resources are deleted
+// the same way, but it is only flagged as pending reissue, so the next
+// handshake for it (see GetCertificate and NeedsReissue) treats it as
+// a cache miss and falls through to the on-demand decision function --
+// which now also sees no existing resources in storage and actually
+// reissues, rather than ObtainCertContext silently no-op'ing against
+// files that were never removed. Its hostname entry is left in place
+// so that handshake can find the old hash and forget it afterwards.
+func (cfg *Config) CheckOCSPAndReplaceIfRevoked(ctx context.Context, certHash string, names []string, ocspResp *ocsp.Response) error {
+	if ocspResp == nil || ocspResp.Status != ocsp.Revoked {
+		return nil
+	}
+
+	if cfg.onDemandCerts.isOnDemand(certHash) {
+		if err := cfg.deleteCertResourcesFromAnyIssuer(names); err != nil {
+			return fmt.Errorf("deleting revoked on-demand certificate: %v", err)
+		}
+		cfg.onDemandCerts.markPendingReissue(certHash)
+		return nil
+	}
+
+	return cfg.replaceRevokedCert(ctx, certHash, names)
+}
+
+// evictCachedCert removes names from cfg.certificates wherever they
+// currently map to certHash, so that a revoked certificate already
+// evicted in memory can no longer be served by hostname lookup even
+// though its resources may still sit in storage or in the hash-keyed
+// certificate cache awaiting cleanup.
+func (cfg *Config) evictCachedCert(certHash string, names []string) {
+	cfg.certificatesMu.Lock()
+	defer cfg.certificatesMu.Unlock()
+	for _, name := range names {
+		if cfg.certificates[name] == certHash {
+			delete(cfg.certificates, name)
+		}
+	}
+}
+
+// replaceRevokedCert deletes the certificate resources for names
+// from storage, obtains a fresh certificate to replace them, caches
+// it, and fires the "cert_revoked_replaced" event with the old and
+// new certificate hashes.
+func (cfg *Config) replaceRevokedCert(ctx context.Context, oldHash string, names []string) error {
+	if err := cfg.deleteCertResourcesFromAnyIssuer(names); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		if err := cfg.ObtainCertContext(ctx, name, false); err != nil {
+			return fmt.Errorf("%s: re-obtaining revoked certificate: %v", name, err)
+		}
+
+		newCert, err := cfg.CacheManagedCertificate(name)
+		if err != nil {
+			return fmt.Errorf("%s: caching replacement certificate: %v", name, err)
+		}
+
+		cfg.onDemandCerts.unmark(oldHash)
+
+		if cfg.OnEvent != nil {
+			cfg.OnEvent("cert_revoked_replaced", map[string]string{
+				"old_hash": oldHash,
+				"new_hash": newCert.Hash,
+			})
+		}
+	}
+
+	return nil
+}
+
+// deleteCertResourcesFromAnyIssuer deletes the complete certificate
+// resource set for each of names from storage, from whichever of
+// cfg.Issuers currently has one. A name with no resources on disk is
+// left alone.
+func (cfg *Config) deleteCertResourcesFromAnyIssuer(names []string) error {
+	for _, name := range names {
+		for _, iss := range cfg.Issuers {
+			issuerKey := issuerKeyOf(iss)
+			if !cfg.storageHasCertResources(issuerKey, name) {
+				continue
+			}
+			if err := cfg.deleteCertResources(issuerKey, name); err != nil {
+				return fmt.Errorf("%s: deleting revoked certificate: %v", name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// deleteCertResources removes the certificate, private key, and
+// metadata for domain issued by issuerKey from storage.
+func (cfg *Config) deleteCertResources(issuerKey, domain string) error {
+	err := cfg.certCache.storage.Delete(StorageKeys.SiteCert(issuerKey, domain))
+	if err != nil {
+		return err
+	}
+	err = cfg.certCache.storage.Delete(StorageKeys.SitePrivateKey(issuerKey, domain))
+	if err != nil {
+		return err
+	}
+	return cfg.certCache.storage.Delete(StorageKeys.SiteMeta(issuerKey, domain))
+}
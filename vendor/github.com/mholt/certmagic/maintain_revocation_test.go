@@ -0,0 +1,118 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import "testing"
+
+// TestOnDemandTrackerPendingReissue exercises the state transitions
+// CheckOCSPAndReplaceIfRevoked relies on: an on-demand cert starts
+// out not pending reissue, becomes pending once flagged, and is no
+// longer on-demand or pending once the tracker forgets it (as
+// replaceRevokedCert does after successfully reissuing).
+func TestOnDemandTrackerPendingReissue(t *testing.T) {
+	var tr onDemandTracker
+	const hash = "deadbeef"
+
+	if tr.isOnDemand(hash) || tr.isPendingReissue(hash) {
+		t.Fatalf("fresh tracker should know nothing about %s", hash)
+	}
+
+	tr.mark(hash)
+	if !tr.isOnDemand(hash) {
+		t.Fatalf("mark(%s) should make isOnDemand true", hash)
+	}
+	if tr.isPendingReissue(hash) {
+		t.Fatalf("mark(%s) alone should not flag it pending reissue", hash)
+	}
+
+	tr.markPendingReissue(hash)
+	if !tr.isPendingReissue(hash) {
+		t.Fatalf("markPendingReissue(%s) should make isPendingReissue true", hash)
+	}
+
+	tr.unmark(hash)
+	if tr.isOnDemand(hash) || tr.isPendingReissue(hash) {
+		t.Fatalf("unmark(%s) should clear both on-demand and pending-reissue state", hash)
+	}
+}
+
+// TestOnDemandTrackerIndependentHashes ensures the tracker's maps are
+// keyed per certificate hash, so flagging one on-demand cert as
+// pending reissue can't bleed into another's state.
+func TestOnDemandTrackerIndependentHashes(t *testing.T) {
+	var tr onDemandTracker
+
+	tr.mark("cert-a")
+	tr.mark("cert-b")
+	tr.markPendingReissue("cert-a")
+
+	if !tr.isPendingReissue("cert-a") {
+		t.Fatal("cert-a should be pending reissue")
+	}
+	if tr.isPendingReissue("cert-b") {
+		t.Fatal("cert-b should not be affected by cert-a's pending-reissue flag")
+	}
+	if !tr.isOnDemand("cert-b") {
+		t.Fatal("cert-b should still be tracked as on-demand")
+	}
+}
+
+// TestOnDemandTrackerReissueCycleForgetsOldHash models the full
+// obtain/revoke/reissue lifecycle GetCertificate and
+// CheckOCSPAndReplaceIfRevoked's on-demand branch drive the tracker
+// through (cache.go and storage.go aren't part of this package
+// snapshot, so a real end-to-end test through GetCertificate itself
+// isn't possible here; this exercises the same tracker calls those
+// two functions make, in the same order).
+//
+// It guards against onDemandTracker growing one stale entry per
+// revocation forever, and against a revoked cert's old hash still
+// answering isPendingReissue after it's been replaced.
+func TestOnDemandTrackerReissueCycleForgetsOldHash(t *testing.T) {
+	var tr onDemandTracker
+	const oldHash = "old-cert-hash"
+	const newHash = "new-cert-hash"
+
+	// GetCertificate, first handshake: obtains oldHash on demand.
+	tr.mark(oldHash)
+
+	// CheckOCSPAndReplaceIfRevoked's on-demand branch, after OCSP
+	// reports oldHash revoked: flags it pending reissue rather than
+	// replacing it immediately.
+	if !tr.isOnDemand(oldHash) {
+		t.Fatal("oldHash should be tracked as on-demand before reissue")
+	}
+	tr.markPendingReissue(oldHash)
+
+	// GetCertificate, next handshake: sees isPendingReissue(oldHash),
+	// reissues via obtainOnDemand (consulting the decision function
+	// again, since this goes through obtainOnDemand just like any
+	// other cache miss), marks the new hash, and must forget oldHash.
+	if !tr.isPendingReissue(oldHash) {
+		t.Fatal("oldHash should be pending reissue before the next handshake")
+	}
+	tr.mark(newHash)
+	tr.unmark(oldHash)
+
+	if tr.isOnDemand(oldHash) || tr.isPendingReissue(oldHash) {
+		t.Fatal("oldHash should be forgotten entirely after reissue, not leaked")
+	}
+	if !tr.isOnDemand(newHash) {
+		t.Fatal("newHash should be tracked as on-demand after reissue")
+	}
+	if tr.isPendingReissue(newHash) {
+		t.Fatal("newHash should not start out pending reissue")
+	}
+}
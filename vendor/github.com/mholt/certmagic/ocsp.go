@@ -0,0 +1,68 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// fetchOCSPStaple requests a fresh OCSP response for the DER-encoded
+// leaf certificate leafDER from the responder named in the
+// certificate itself, verified against the DER-encoded issuer
+// certificate issuerDER.
+func fetchOCSPStaple(ctx context.Context, leafDER, issuerDER []byte) (*ocsp.Response, error) {
+	leaf, err := x509.ParseCertificate(leafDER)
+	if err != nil {
+		return nil, fmt.Errorf("parsing leaf certificate: %v", err)
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, fmt.Errorf("certificate has no OCSP server")
+	}
+	issuer, err := x509.ParseCertificate(issuerDER)
+	if err != nil {
+		return nil, fmt.Errorf("parsing issuer certificate: %v", err)
+	}
+
+	reqDER, err := ocsp.CreateRequest(leaf, issuer, nil)
+	if err != nil {
+		return nil, fmt.Errorf("creating OCSP request: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, leaf.OCSPServer[0], bytes.NewReader(reqDER))
+	if err != nil {
+		return nil, fmt.Errorf("building OCSP request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/ocsp-request")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting OCSP staple: %v", err)
+	}
+	defer resp.Body.Close()
+
+	respDER, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading OCSP response: %v", err)
+	}
+
+	return ocsp.ParseResponse(respDER, issuer)
+}
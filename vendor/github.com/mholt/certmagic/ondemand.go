@@ -0,0 +1,94 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"strings"
+)
+
+// GetCertificate is cfg's tls.Config.GetCertificate callback (see
+// TLSConfig). It serves the cached certificate for the handshake's
+// SNI name, or, if cfg.OnDemand is configured and none is cached yet
+// -- or the cached one was revoked and is pending reissue, see
+// NeedsReissue -- obtains one just-in-time.
+func (cfg *Config) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	name := strings.ToLower(strings.TrimSuffix(hello.ServerName, "."))
+	if name == "" {
+		return nil, fmt.Errorf("client did not provide an SNI server name")
+	}
+
+	cfg.certificatesMu.Lock()
+	hash, cached := cfg.certificates[name]
+	cfg.certificatesMu.Unlock()
+
+	reissuing := cached && cfg.NeedsReissue(hash)
+	if reissuing {
+		cached = false
+	}
+
+	if !cached {
+		if err := cfg.obtainOnDemand(name); err != nil {
+			return nil, err
+		}
+	}
+
+	managed, err := cfg.CacheManagedCertificate(name)
+	if err != nil {
+		return nil, fmt.Errorf("%s: loading certificate: %v", name, err)
+	}
+
+	if !cached {
+		cfg.MarkOnDemandCert(managed.Hash)
+	}
+	if reissuing {
+		// The revoked certificate's entry was never going to be
+		// looked up under its old hash again, so forget it now --
+		// otherwise onDemandCerts.set and .pendingReissue would
+		// accumulate one stale entry per revocation for the life of
+		// the process.
+		cfg.onDemandCerts.unmark(hash)
+	}
+
+	return &managed.Certificate, nil
+}
+
+// obtainOnDemand checks that name is eligible for on-demand TLS and,
+// if so, obtains a certificate for it now. It honors
+// cfg.CertObtainTimeout so a handshake can't hang indefinitely on an
+// ACME order, and checks cfg.CheckRateLimit first so a name that's
+// currently rate limited fails fast instead of burning that timeout
+// on an order that's certain to be rejected.
+func (cfg *Config) obtainOnDemand(name string) error {
+	if cfg.OnDemand == nil {
+		return fmt.Errorf("%s: no certificate available and on-demand TLS is not enabled", name)
+	}
+	if !cfg.OnDemand.whitelistContains(name) {
+		return fmt.Errorf("%s: not whitelisted for on-demand TLS", name)
+	}
+	if err := cfg.CheckRateLimit(name); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.CertObtainTimeout)
+	defer cancel()
+
+	if err := cfg.ObtainCertContext(ctx, name, false); err != nil {
+		return fmt.Errorf("%s: obtaining certificate on demand: %v", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,187 @@
+// Copyright 2015 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package certmagic
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// RateLimitScope controls which part of a (issuer, account, name)
+// tuple a RateLimit's key is derived from.
+type RateLimitScope int
+
+const (
+	// ScopeRegisteredDomain limits issuances per registered domain
+	// (eTLD+1), e.g. Let's Encrypt's 50 certs/registered-domain/week.
+	ScopeRegisteredDomain RateLimitScope = iota
+
+	// ScopeName limits issuances per exact name, e.g. Let's
+	// Encrypt's 5 duplicate certs/week.
+	ScopeName
+
+	// ScopeAccount limits issuances per ACME account regardless of
+	// name, e.g. Let's Encrypt's 300 new orders/account/3h.
+	ScopeAccount
+)
+
+// RateLimit describes a sliding-window limit on how many successful
+// issuances are allowed, for a given Scope, within Window.
+type RateLimit struct {
+	Window    time.Duration
+	MaxEvents int
+	Scope     RateLimitScope
+}
+
+// DefaultRateLimits are sensible defaults modeled on Let's Encrypt's
+// published rate limits. They are used when Config.RateLimits is
+// empty.
+var DefaultRateLimits = []RateLimit{
+	{Window: 7 * 24 * time.Hour, MaxEvents: 50, Scope: ScopeRegisteredDomain},
+	{Window: 7 * 24 * time.Hour, MaxEvents: 5, Scope: ScopeName},
+	{Window: 3 * time.Hour, MaxEvents: 300, Scope: ScopeAccount},
+}
+
+// ErrRateLimited is returned when an issuance is rejected because it
+// would exceed one of cfg.RateLimits. RetryAfter is how long to wait
+// before the same key is likely to be allowed again.
+type ErrRateLimited struct {
+	Key        string
+	RetryAfter time.Duration
+}
+
+func (e ErrRateLimited) Error() string {
+	return fmt.Sprintf("rate limited: %s: retry after %s", e.Key, e.RetryAfter)
+}
+
+// rateLimiter tracks, per key, a sliding window of the timestamps of
+// recent successful issuances.
+type rateLimiter struct {
+	mu      sync.Mutex
+	history map[string][]time.Time
+}
+
+// allow reports whether a new event for key is allowed under the
+// given window/max, evicting timestamps older than window as it
+// goes. If not allowed, it also returns how long to wait before
+// trying again.
+func (rl *rateLimiter) allow(key string, window time.Duration, max int, now time.Time) (bool, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	cutoff := now.Add(-window)
+	kept := rl.history[key][:0]
+	for _, t := range rl.history[key] {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+
+	if rl.history == nil {
+		rl.history = make(map[string][]time.Time)
+	}
+	rl.history[key] = kept
+
+	if max <= 0 {
+		// a non-positive max blocks this scope outright; there's
+		// no timestamp to measure a retry against, so just ask
+		// the caller to wait out a full window.
+		return false, window
+	}
+
+	if len(kept) >= max {
+		return false, kept[0].Add(window).Sub(now)
+	}
+
+	return true, 0
+}
+
+// record appends now to key's history of successful issuances.
+func (rl *rateLimiter) record(key string, now time.Time) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	if rl.history == nil {
+		rl.history = make(map[string][]time.Time)
+	}
+	rl.history[key] = append(rl.history[key], now)
+}
+
+// rateLimitKey builds the sliding-window key for iss/name under scope.
+func rateLimitKey(iss Issuer, name string, scope RateLimitScope) string {
+	switch scope {
+	case ScopeRegisteredDomain:
+		regDomain, err := publicsuffix.EffectiveTLDPlusOne(name)
+		if err != nil {
+			regDomain = name
+		}
+		return fmt.Sprintf("%s|domain|%s", issuerKeyOf(iss), regDomain)
+	case ScopeAccount:
+		return fmt.Sprintf("%s|account", issuerKeyOf(iss))
+	default: // ScopeName
+		return fmt.Sprintf("%s|name|%s", issuerKeyOf(iss), name)
+	}
+}
+
+// checkRateLimit returns a non-nil ErrRateLimited if issuing a
+// certificate for name via iss right now would exceed any of
+// cfg.RateLimits.
+func (cfg *Config) checkRateLimit(iss Issuer, name string) error {
+	now := time.Now()
+	for _, rl := range cfg.effectiveRateLimits() {
+		key := rateLimitKey(iss, name, rl.Scope)
+		if ok, retryAfter := cfg.rateLimiter.allow(key, rl.Window, rl.MaxEvents, now); !ok {
+			return ErrRateLimited{Key: key, RetryAfter: retryAfter}
+		}
+	}
+	return nil
+}
+
+// recordIssuance records a successful issuance for name via iss
+// against every configured rate limit, so future checks see it.
+func (cfg *Config) recordIssuance(iss Issuer, name string) {
+	now := time.Now()
+	for _, rl := range cfg.effectiveRateLimits() {
+		cfg.rateLimiter.record(rateLimitKey(iss, name, rl.Scope), now)
+	}
+}
+
+// effectiveRateLimits returns cfg.RateLimits, falling back to
+// DefaultRateLimits if cfg.RateLimits is empty.
+func (cfg *Config) effectiveRateLimits() []RateLimit {
+	if len(cfg.RateLimits) == 0 {
+		return DefaultRateLimits
+	}
+	return cfg.RateLimits
+}
+
+// CheckRateLimit reports an ErrRateLimited if obtaining a certificate
+// for name right now would exceed cfg's rate limits for every issuer
+// in cfg.Issuers (i.e. every issuer is currently rate limited for
+// name). On-demand TLS handshakes can call this to fail fast instead
+// of blocking for CertObtainTimeout only to be rejected by the CA.
+func (cfg *Config) CheckRateLimit(name string) error {
+	var lastErr error
+	for _, iss := range cfg.Issuers {
+		err := cfg.checkRateLimit(iss, name)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+	}
+	return lastErr
+}